@@ -0,0 +1,283 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/coreos/clair/utils/types"
+)
+
+var reportsBucket = []byte("reports")
+
+// serve runs clair-scanner as a long-lived daemon: it periodically walks
+// every repository/tag on registry, scans each image through Clair, and
+// exposes the resulting reports over a small HTTP API.
+func serve(registry string, interval time.Duration, dbPath string) error {
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return fmt.Errorf("could not open report database %s: %s", dbPath, err)
+	}
+	defer db.Close()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(reportsBucket)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	d := &daemon{db: db, registry: registry}
+
+	go d.scanLoop(interval)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repositories", d.handleRepositories)
+	mux.HandleFunc("/repositories/", d.handleRepositoryTagsOrReport)
+	mux.HandleFunc("/reports/", d.handleRepositoryTagsOrReport)
+	log.Printf("Listening for API requests on :%d\n", httpPort)
+	return http.ListenAndServe(fmt.Sprintf(":%d", httpPort), mux)
+}
+
+type daemon struct {
+	db       *bolt.DB
+	registry string
+}
+
+// scanLoop re-scans the registry's catalog every interval. See scanOne for
+// what is and isn't skipped when an image's digest hasn't changed.
+func (d *daemon) scanLoop(interval time.Duration) {
+	for {
+		repos, err := registryCatalog(d.registry)
+		if err != nil {
+			log.Printf("Could not list catalog: %s\n", err)
+		}
+
+		for _, repo := range repos {
+			tags, err := registryTags(d.registry, repo)
+			if err != nil {
+				log.Printf("Could not list tags for %s: %s\n", repo, err)
+				continue
+			}
+
+			for _, tag := range tags {
+				if err := d.scanOne(repo, tag); err != nil {
+					log.Printf("Could not scan %s:%s: %s\n", repo, tag, err)
+				}
+			}
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// scanOne scans a single repo:tag. When the manifest digest matches the
+// last stored report, the (expensive) layer upload/analysis is skipped
+// since Clair has already seen those exact layers; vulnerabilities are
+// still re-fetched from Clair every time, so CVEs it discovers after the
+// fact for an unchanged image resurface on the next scheduled walk instead
+// of being cached away forever.
+func (d *daemon) scanOne(repo, tag string) error {
+	image := d.registry + "/" + repo + ":" + tag
+	registry, repository, resolvedTag := splitImageName(image)
+	auth, err := registryAuth(registry, repository)
+	if err != nil {
+		return err
+	}
+	manifest, err := registryManifest(registry, repository, resolvedTag, auth)
+	if err != nil {
+		return err
+	}
+	digest := manifestDigest(manifest)
+
+	source := registrySource{}
+	layers, _, cleanup, err := source.Layers(image)
+	defer cleanup()
+	if err != nil {
+		return err
+	}
+
+	existing, unchanged := d.load(repo, tag)
+	if !unchanged || existing.Digest != digest {
+		if err := analyzeLayers(*endpoint, layers, *concurrency, *maxRetries, *requestTimeout); err != nil {
+			return err
+		}
+	}
+
+	clairClient := &http.Client{Timeout: *requestTimeout}
+	layer, err := getLayerWithRetry(clairClient, *endpoint, layers[len(layers)-1].Name, *maxRetries)
+	if err != nil {
+		return err
+	}
+
+	var vulnerabilities []vulnerabilityInfo
+	for _, feature := range layer.Features {
+		for _, vulnerability := range feature.Vulnerabilities {
+			vulnerabilities = append(vulnerabilities, vulnerabilityInfo{
+				vulnerability: vulnerability,
+				feature:       feature,
+				severity:      types.Priority(vulnerability.Severity),
+			})
+		}
+	}
+
+	report := newReport(repo, vulnerabilities)
+	report.Registry = registry
+	report.Tag = tag
+
+	return d.store(repo, tag, &storedReport{Digest: digest, Report: *report})
+}
+
+// storedReport is what is persisted per repo:tag, so re-scans can be
+// short-circuited when the image hasn't changed.
+type storedReport struct {
+	Digest string
+	Report Report
+}
+
+func (d *daemon) load(repo, tag string) (*storedReport, bool) {
+	var sr storedReport
+	found := false
+	d.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(reportsBucket).Get(reportKey(repo, tag))
+		if data == nil {
+			return nil
+		}
+		if err := json.Unmarshal(data, &sr); err == nil {
+			found = true
+		}
+		return nil
+	})
+	return &sr, found
+}
+
+func (d *daemon) store(repo, tag string, sr *storedReport) error {
+	data, err := json.Marshal(sr)
+	if err != nil {
+		return err
+	}
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(reportsBucket).Put(reportKey(repo, tag), data)
+	})
+}
+
+func reportKey(repo, tag string) []byte {
+	return []byte(repo + ":" + tag)
+}
+
+func (d *daemon) handleRepositories(w http.ResponseWriter, r *http.Request) {
+	repos, err := registryCatalog(d.registry)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	json.NewEncoder(w).Encode(repos)
+}
+
+// handleRepositoryTagsOrReport serves both GET /repositories/{repo}/tags and
+// GET /reports/{repo}/{tag} since both are prefixed paths under the same
+// mux entry. {repo} itself may contain slashes (e.g. "library/ubuntu", or
+// any nested org path), so it's peeled off by trimming the fixed prefix and
+// suffix rather than by positionally splitting on "/".
+func (d *daemon) handleRepositoryTagsOrReport(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+
+	if strings.HasPrefix(path, "repositories/") && strings.HasSuffix(path, "/tags") {
+		repo := strings.TrimSuffix(strings.TrimPrefix(path, "repositories/"), "/tags")
+		tags, err := registryTags(d.registry, repo)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		json.NewEncoder(w).Encode(tags)
+		return
+	}
+
+	if strings.HasPrefix(path, "reports/") {
+		rest := strings.TrimPrefix(path, "reports/")
+		// Tags cannot contain "/", so the last segment is always the tag
+		// and everything before it is the (possibly multi-segment) repo.
+		sep := strings.LastIndex(rest, "/")
+		if sep < 0 {
+			http.NotFound(w, r)
+			return
+		}
+		repo, tag := rest[:sep], rest[sep+1:]
+
+		sr, ok := d.load(repo, tag)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("format") == "html" {
+			renderReportHTML(w, &sr.Report)
+			return
+		}
+		json.NewEncoder(w).Encode(sr.Report)
+		return
+	}
+
+	http.NotFound(w, r)
+}
+
+var reportHTMLTemplate = template.Must(template.New("report").Funcs(template.FuncMap{"severityColor": severityColor}).Parse(`
+<html>
+<head><title>Clair report for {{.Image}}</title></head>
+<body>
+<h1>{{.Image}}{{if .Tag}}:{{.Tag}}{{end}}</h1>
+<p>Generated at {{.GeneratedAt}}</p>
+{{range $severity, $vulns := .VulnerabilitiesBySeverity}}
+<h2 style="color:{{severityColor $severity}}">{{$severity}} ({{len $vulns}})</h2>
+<ul>
+{{range $vulns}}
+<li>{{.Name}} &mdash; {{.FeatureName}} @ {{.FeatureVersion}}{{if .FixedBy}} (fixed by {{.FixedBy}}){{end}}</li>
+{{end}}
+</ul>
+{{end}}
+</body>
+</html>
+`))
+
+func renderReportHTML(w http.ResponseWriter, report *Report) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := reportHTMLTemplate.Execute(w, report); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func severityColor(severity string) string {
+	switch types.Priority(severity) {
+	case types.High, types.Critical, types.Defcon1:
+		return "red"
+	case types.Medium:
+		return "orange"
+	default:
+		return "black"
+	}
+}
+
+func manifestDigest(manifest *ociManifest) string {
+	data, _ := json.Marshal(manifest)
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf("sha256:%x", sum)
+}
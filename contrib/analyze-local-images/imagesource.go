@@ -0,0 +1,589 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// imageLayer is a single layer of an image, ready to be analyzed by Clair.
+// Path is either a path on local disk or an HTTP URL Clair can fetch the
+// blob from; for the registry source this URL points at registryProxy
+// rather than the registry itself, since Clair cannot authenticate to it.
+type imageLayer struct {
+	Name       string
+	ParentName string
+	Path       string
+	Format     string // "Docker" or "OCI"
+}
+
+// imageSource resolves an image name into an ordered list of layers (parent
+// first), the local directory those layers' Paths are rooted at (empty if
+// Paths are already remote URLs, as with registrySource), and a cleanup
+// function to run once analysis is done.
+type imageSource interface {
+	Layers(imageName string) (layers []imageLayer, rootDir string, cleanup func(), err error)
+}
+
+// imageSourceFor returns the imageSource for the given -image-format value.
+func imageSourceFor(format string) (imageSource, error) {
+	switch format {
+	case "", "docker":
+		return dockerSaveSource{}, nil
+	case "oci":
+		return ociSource{}, nil
+	case "registry":
+		return registrySource{}, nil
+	default:
+		return nil, fmt.Errorf("unknown image format %q", format)
+	}
+}
+
+// dockerSaveSource obtains layers by shelling out to `docker save`, the
+// original behavior of this tool.
+type dockerSaveSource struct{}
+
+func (dockerSaveSource) Layers(imageName string) ([]imageLayer, string, func(), error) {
+	path, err := save(imageName)
+	cleanup := func() { os.RemoveAll(path) }
+	if err != nil {
+		return nil, "", cleanup, err
+	}
+
+	layerIDs, err := historyFromManifest(path)
+	if err != nil {
+		layerIDs, err = historyFromCommand(imageName)
+	}
+	if err != nil || len(layerIDs) == 0 {
+		return nil, "", cleanup, fmt.Errorf("could not get image's history: %s", err)
+	}
+
+	layers := make([]imageLayer, len(layerIDs))
+	for i, id := range layerIDs {
+		var parent string
+		if i > 0 {
+			parent = layerIDs[i-1]
+		}
+		layers[i] = imageLayer{
+			Name:       id,
+			ParentName: parent,
+			Path:       filepath.Join(path, id, "layer.tar"),
+			Format:     "Docker",
+		}
+	}
+
+	return layers, path, cleanup, nil
+}
+
+// ociSource reads an OCI image layout directory or tarball (index.json +
+// blobs/sha256/...) as described by the OCI Image Format Specification.
+type ociSource struct{}
+
+type ociIndex struct {
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+}
+
+type ociManifest struct {
+	Config ociDescriptor   `json:"config"`
+	Layers []ociDescriptor `json:"layers"`
+}
+
+func (ociSource) Layers(imagePath string) ([]imageLayer, string, func(), error) {
+	root, cleanup, err := ociRoot(imagePath)
+	if err != nil {
+		return nil, "", cleanup, err
+	}
+
+	index, err := ociReadIndex(root)
+	if err != nil {
+		return nil, "", cleanup, err
+	}
+	if len(index.Manifests) == 0 {
+		return nil, "", cleanup, errors.New("OCI layout contains no manifests")
+	}
+
+	manifestPath := ociBlobPath(root, index.Manifests[0].Digest)
+	manifestBytes, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return nil, "", cleanup, err
+	}
+	var manifest ociManifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return nil, "", cleanup, err
+	}
+
+	layers := make([]imageLayer, len(manifest.Layers))
+	var parent string
+	for i, l := range manifest.Layers {
+		name := ociDigestToName(l.Digest)
+		layers[i] = imageLayer{
+			Name:       name,
+			ParentName: parent,
+			Path:       ociBlobPath(root, l.Digest),
+			Format:     "OCI",
+		}
+		parent = name
+	}
+
+	return layers, root, cleanup, nil
+}
+
+// ociRoot resolves imagePath to a directory containing index.json: if
+// imagePath is already a directory it's returned as-is with a no-op
+// cleanup, otherwise it's treated as a tarball of an OCI image layout (the
+// form produced by `docker save`/`skopeo copy` for oci-archive, and the one
+// most registries hand out for download) and extracted to a temporary
+// directory that cleanup removes.
+func ociRoot(imagePath string) (string, func(), error) {
+	noop := func() {}
+
+	info, err := os.Stat(imagePath)
+	if err != nil {
+		return "", noop, err
+	}
+	if info.IsDir() {
+		return imagePath, noop, nil
+	}
+
+	dir, err := ioutil.TempDir("", "clair-oci-")
+	if err != nil {
+		return "", noop, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	if err := extractOCITarball(imagePath, dir); err != nil {
+		return "", cleanup, err
+	}
+	return dir, cleanup, nil
+}
+
+// extractOCITarball extracts a (optionally gzip-compressed) tar archive of
+// an OCI image layout into destDir.
+func extractOCITarball(archivePath, destDir string) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(archivePath, ".gz") || strings.HasSuffix(archivePath, ".tgz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		target, err := ociSafeJoin(destDir, header.Name)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+
+		out, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, tr); err != nil {
+			out.Close()
+			return err
+		}
+		out.Close()
+	}
+}
+
+// ociSafeJoin joins destDir and name, rejecting any entry (e.g. one
+// containing "../") that would extract outside of destDir.
+func ociSafeJoin(destDir, name string) (string, error) {
+	target := filepath.Join(destDir, name)
+	if target != destDir && !strings.HasPrefix(target, destDir+string(os.PathSeparator)) {
+		return "", fmt.Errorf("tar entry %q escapes destination directory", name)
+	}
+	return target, nil
+}
+
+func ociReadIndex(imagePath string) (*ociIndex, error) {
+	data, err := ioutil.ReadFile(filepath.Join(imagePath, "index.json"))
+	if err != nil {
+		return nil, err
+	}
+	var index ociIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, err
+	}
+	return &index, nil
+}
+
+// ociBlobPath maps a "sha256:<hex>" digest to its blobs/sha256/<hex> path.
+func ociBlobPath(imagePath, digest string) string {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 {
+		return filepath.Join(imagePath, digest)
+	}
+	return filepath.Join(imagePath, "blobs", parts[0], parts[1])
+}
+
+func ociDigestToName(digest string) string {
+	return strings.TrimPrefix(digest, "sha256:")
+}
+
+// registrySource pulls an image directly from a Docker Registry v2 endpoint
+// (e.g. "registry.example.com/foo:bar"), without requiring a local Docker
+// daemon. Clair has no notion of registry auth, so layer blobs are not
+// handed to it as bare registry URLs (which would 401 against anything but
+// a fully anonymous registry); instead they're served through the local
+// registryProxy, which holds the bearer token and attaches it when
+// forwarding Clair's request.
+type registrySource struct{}
+
+func (registrySource) Layers(imageName string) ([]imageLayer, string, func(), error) {
+	noop := func() {}
+	registry, repository, tag := splitImageName(imageName)
+
+	auth, err := registryAuth(registry, repository)
+	if err != nil {
+		return nil, "", noop, err
+	}
+
+	manifest, err := registryManifest(registry, repository, tag, auth)
+	if err != nil {
+		return nil, "", noop, err
+	}
+
+	allowedHost := endpointHost(*endpoint)
+	startRegistryProxy(allowedHost)
+	proxyRoot := fmt.Sprintf("http://%s:%d", *myAddress, registryProxyPort)
+
+	layers := make([]imageLayer, len(manifest.Layers))
+	var parent string
+	for i, l := range manifest.Layers {
+		name := ociDigestToName(l.Digest)
+		blobURL := fmt.Sprintf("https://%s/v2/%s/blobs/%s", registry, repository, l.Digest)
+		proxy.register(name, blobURL, auth)
+
+		layers[i] = imageLayer{
+			Name:       name,
+			ParentName: parent,
+			Path:       proxyRoot + "/" + name,
+			Format:     "Docker",
+		}
+		parent = name
+	}
+
+	// Layer paths point at registryProxy, not at a local directory, so
+	// there is nothing for the caller to serve over HTTP itself.
+	return layers, "", noop, nil
+}
+
+// endpointHost extracts the bare host (no scheme, no port) that Clair will
+// connect from, so registryProxy can restrict access the same way
+// listenHTTP does for local layer files.
+func endpointHost(endpoint string) string {
+	host := strings.TrimPrefix(endpoint, "http://")
+	host = strings.TrimPrefix(host, "https://")
+	if portIndex := strings.Index(host, ":"); portIndex >= 0 {
+		host = host[:portIndex]
+	}
+	return host
+}
+
+// registryProxy lets Clair fetch registry blobs without ever seeing the
+// registry's bearer token: each blob is registered under its layer name,
+// and requests for that name are forwarded to the registry with the
+// Authorization header attached.
+type registryProxy struct {
+	mu    sync.Mutex
+	blobs map[string]registryBlob
+}
+
+type registryBlob struct {
+	url  string
+	auth string
+}
+
+var proxy = &registryProxy{blobs: make(map[string]registryBlob)}
+var proxyStarted sync.Once
+
+func (p *registryProxy) register(name, url, auth string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.blobs[name] = registryBlob{url: url, auth: auth}
+}
+
+func (p *registryProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	blob, ok := p.blobs[strings.TrimPrefix(r.URL.Path, "/")]
+	p.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	req, err := http.NewRequest("GET", blob.url, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if blob.auth != "" {
+		req.Header.Set("Authorization", "Bearer "+blob.auth)
+	}
+
+	resp, err := registryHTTPClient().Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// startRegistryProxy starts, once per process, the local HTTP server that
+// forwards authenticated blob requests to the registry on Clair's behalf,
+// restricted to allowedHost the same way listenHTTP restricts local file
+// serving.
+func startRegistryProxy(allowedHost string) {
+	proxyStarted.Do(func() {
+		go func() {
+			restricted := func(w http.ResponseWriter, r *http.Request) {
+				host, _, err := net.SplitHostPort(r.RemoteAddr)
+				if err != nil || !strings.EqualFold(host, allowedHost) {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				proxy.ServeHTTP(w, r)
+			}
+
+			if err := http.ListenAndServe(fmt.Sprintf(":%d", registryProxyPort), http.HandlerFunc(restricted)); err != nil {
+				log.Printf("An error occurred with the registry blob proxy: %s\n", err)
+			}
+		}()
+		time.Sleep(200 * time.Millisecond)
+	})
+}
+
+// splitImageName splits "registry.example.com/foo:bar" into its registry,
+// repository and tag parts, defaulting to Docker Hub and "latest".
+func splitImageName(imageName string) (registry, repository, tag string) {
+	registry = "registry-1.docker.io"
+	tag = "latest"
+
+	name := imageName
+	if idx := strings.LastIndex(name, ":"); idx > strings.LastIndex(name, "/") {
+		tag = name[idx+1:]
+		name = name[:idx]
+	}
+
+	if slash := strings.Index(name, "/"); slash >= 0 && strings.ContainsAny(name[:slash], ".:") {
+		registry = name[:slash]
+		name = name[slash+1:]
+	}
+
+	repository = name
+	return
+}
+
+// registryHTTPClient returns a client bounded by -request-timeout for calls
+// against the registry itself. -serve's scanLoop runs these synchronously,
+// repo after repo, so an unbounded client would let one unresponsive
+// registry stall that scan - and every scheduled re-scan after it - forever.
+func registryHTTPClient() *http.Client {
+	return &http.Client{Timeout: *requestTimeout}
+}
+
+// registryAuth obtains a bearer token for the repository via the registry's
+// advertised auth realm. When the registry does not answer /v2/ with a
+// Bearer challenge it returns an empty token and requests go out
+// anonymously; Basic authentication is not supported.
+func registryAuth(registry, repository string) (string, error) {
+	client := registryHTTPClient()
+
+	resp, err := client.Get(fmt.Sprintf("https://%s/v2/", registry))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		return "", nil
+	}
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	realm, service, scope := parseBearerChallenge(challenge)
+	if realm == "" {
+		return "", nil
+	}
+
+	url := fmt.Sprintf("%s?service=%s&scope=repository:%s:pull", realm, service, repository)
+	if scope != "" {
+		url = fmt.Sprintf("%s?service=%s&scope=%s", realm, service, scope)
+	}
+
+	tokenResp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer tokenResp.Body.Close()
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(tokenResp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	if token.Token != "" {
+		return token.Token, nil
+	}
+	return token.AccessToken, nil
+}
+
+// parseBearerChallenge extracts realm, service and scope from a
+// `Bearer realm="...",service="...",scope="..."` WWW-Authenticate header.
+func parseBearerChallenge(challenge string) (realm, service, scope string) {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return
+	}
+	for _, part := range strings.Split(strings.TrimPrefix(challenge, "Bearer "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.Trim(kv[1], `"`)
+		switch kv[0] {
+		case "realm":
+			realm = value
+		case "service":
+			service = value
+		case "scope":
+			scope = value
+		}
+	}
+	return
+}
+
+// registryCatalog enumerates every repository on registry via GET
+// /v2/_catalog.
+func registryCatalog(registry string) ([]string, error) {
+	var result struct {
+		Repositories []string `json:"repositories"`
+	}
+	if err := registryGetJSON(registry, "/v2/_catalog", "", &result); err != nil {
+		return nil, err
+	}
+	return result.Repositories, nil
+}
+
+// registryTags enumerates every tag of repository via GET
+// /v2/<repository>/tags/list.
+func registryTags(registry, repository string) ([]string, error) {
+	var result struct {
+		Tags []string `json:"tags"`
+	}
+	if err := registryGetJSON(registry, fmt.Sprintf("/v2/%s/tags/list", repository), repository, &result); err != nil {
+		return nil, err
+	}
+	return result.Tags, nil
+}
+
+func registryGetJSON(registry, path, repository string, v interface{}) error {
+	auth, err := registryAuth(registry, repository)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://%s%s", registry, path), nil)
+	if err != nil {
+		return err
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", "Bearer "+auth)
+	}
+
+	resp, err := registryHTTPClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: got status %d", path, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func registryManifest(registry, repository, tag, auth string) (*ociManifest, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://%s/v2/%s/manifests/%s", registry, repository, tag), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json")
+	if auth != "" {
+		req.Header.Set("Authorization", "Bearer "+auth)
+	}
+
+	resp, err := registryHTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not fetch manifest for %s/%s:%s: got status %d", registry, repository, tag, resp.StatusCode)
+	}
+
+	var manifest ociManifest
+	if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
@@ -27,6 +27,7 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
@@ -42,6 +43,10 @@ const (
 	postLayerURI        = "/v1/layers"
 	getLayerFeaturesURI = "/v1/layers/%s?vulnerabilities"
 	httpPort            = 9279
+	// registryProxyPort is separate from httpPort because, in -serve mode,
+	// the daemon's own HTTP API already owns httpPort while a scan is
+	// concurrently pulling layers through registryProxy.
+	registryProxyPort = 9280
 )
 
 var (
@@ -49,12 +54,25 @@ var (
 	myAddress       = flag.String("my-address", "127.0.0.1", "Address from the point of view of Clair")
 	minimumSeverity = flag.String("minimum-severity", "Negligible", "Minimum severity of vulnerabilities to show (Unknown, Negligible, Low, Medium, High, Critical, Defcon1)")
 	colorMode       = flag.String("color", "auto", "Colorize the output (always, auto, never)")
+	output          = flag.String("output", "", "Write the report to this file as well as printing it to the terminal")
+	format          = flag.String("format", "", "Format of the report written to -output (json, sarif, junit)")
+	failOn          = flag.String("fail-on", "", "Exit non-zero if a vulnerability of this severity or higher is found (Unknown, Negligible, Low, Medium, High, Critical, Defcon1)")
+	failOnCount     = flag.Int("fail-on-count", 0, "Exit non-zero if the total number of vulnerabilities is greater than or equal to this count")
+	imageFormat     = flag.String("image-format", "docker", "How to obtain the image's layers: docker (docker save), oci (OCI image layout directory), or registry (pull directly from a Docker Registry v2 endpoint)")
+	whitelistPath   = flag.String("whitelist", "", "Path to a YAML policy of accepted vulnerabilities to suppress or downgrade")
+	concurrency     = flag.Int("concurrency", 1, "Number of layers to analyze in parallel")
+	maxRetries      = flag.Int("max-retries", 3, "Maximum number of retries for a layer analysis request that fails with a 5xx status or times out")
+	requestTimeout  = flag.Duration("request-timeout", 60*time.Second, "Timeout for a single layer analysis request to Clair")
+	serveMode       = flag.Bool("serve", false, "Run as a daemon that scans a registry's catalog on a schedule instead of scanning a single image")
+	scanInterval    = flag.Duration("scan-interval", time.Hour, "How often to re-walk the registry catalog in -serve mode")
+	dbPath          = flag.String("db-path", "clair-scanner.db", "Path to the BoltDB file used to persist reports in -serve mode")
 )
 
 type vulnerabilityInfo struct {
 	vulnerability v1.Vulnerability
 	feature       v1.Feature
 	severity      types.Priority
+	justification string
 }
 
 type By func(v1, v2 vulnerabilityInfo) bool
@@ -87,7 +105,7 @@ func (s *sorter) Less(i, j int) bool {
 func main() {
 	// Parse command-line arguments.
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [options] image-id\n\nOptions:\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] image-id\n   or: %s [options] -serve registry-host\n\nOptions:\n", os.Args[0], os.Args[0])
 		flag.PrintDefaults()
 	}
 	flag.Parse()
@@ -96,6 +114,16 @@ func main() {
 		flag.Usage()
 		os.Exit(1)
 	}
+
+	if *serveMode {
+		registry := flag.Args()[0]
+		if err := serve(registry, *scanInterval, *dbPath); err != nil {
+			log.Printf("Daemon exited: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	imageName := flag.Args()[0]
 
 	minSeverity := types.Priority(*minimumSeverity)
@@ -104,66 +132,87 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *failOn != "" && !types.Priority(*failOn).IsValid() {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	var policy *whitelist
+	if *whitelistPath != "" {
+		var err error
+		policy, err = loadWhitelist(*whitelistPath)
+		if err != nil {
+			fmt.Printf("Could not load whitelist: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	var reporter Reporter
+	if *format != "" {
+		var err error
+		reporter, err = reporterFor(*format)
+		if err != nil {
+			fmt.Printf("%s\n", err)
+			os.Exit(1)
+		}
+	}
+
 	if *colorMode == "never" {
 		color.NoColor = true
 	} else if *colorMode == "always" {
 		color.NoColor = false
 	}
 
-	// Save image.
-	log.Printf("Saving %s to local disk (this may take some time)", imageName)
-	path, err := save(imageName)
-	defer os.RemoveAll(path)
+	// Resolve the image into layers.
+	source, err := imageSourceFor(*imageFormat)
 	if err != nil {
-		fmt.Printf("Could not save image: %s\n", err)
+		fmt.Printf("%s\n", err)
 		os.Exit(1)
 	}
 
-	// Retrieve history.
-	log.Println("Retrieving image history")
-	layerIDs, err := historyFromManifest(path)
+	log.Printf("Retrieving %s layers (this may take some time)", imageName)
+	layers, rootDir, cleanup, err := source.Layers(imageName)
+	defer cleanup()
 	if err != nil {
-		layerIDs, err = historyFromCommand(imageName)
-	}
-	if err != nil || len(layerIDs) == 0 {
-		log.Printf("Could not get image's history: %s\n", err)
+		fmt.Printf("Could not retrieve image layers: %s\n", err)
 		os.Exit(1)
 	}
 
-	// Setup a simple HTTP server if Clair is not local.
-	if !strings.Contains(*endpoint, "127.0.0.1") && !strings.Contains(*endpoint, "localhost") {
+	// Setup a simple HTTP server if Clair is not local and layers live on
+	// local disk (the registry source already hands Clair registryProxy URLs).
+	if rootDir != "" && !strings.Contains(*endpoint, "127.0.0.1") && !strings.Contains(*endpoint, "localhost") {
 		allowedHost := strings.TrimPrefix(*endpoint, "http://")
 		portIndex := strings.Index(allowedHost, ":")
 		if portIndex >= 0 {
 			allowedHost = allowedHost[:portIndex]
 		}
 
-		go listenHTTP(path, allowedHost)
+		go listenHTTP(rootDir, allowedHost)
 
-		path = "http://" + *myAddress + ":" + strconv.Itoa(httpPort)
+		httpRoot := "http://" + *myAddress + ":" + strconv.Itoa(httpPort)
 		time.Sleep(200 * time.Millisecond)
+
+		for i := range layers {
+			rel, err := filepath.Rel(rootDir, layers[i].Path)
+			if err != nil {
+				fmt.Printf("Could not serve layer %s: %s\n", layers[i].Name, err)
+				os.Exit(1)
+			}
+			layers[i].Path = httpRoot + "/" + filepath.ToSlash(rel)
+		}
 	}
 
 	// Analyze layers.
-	log.Printf("Analyzing %d layers... \n", len(layerIDs))
-	for i := 0; i < len(layerIDs); i++ {
-		log.Printf("Analyzing %s\n", layerIDs[i])
-
-		var err error
-		if i > 0 {
-			err = analyzeLayer(*endpoint, path+"/"+layerIDs[i]+"/layer.tar", layerIDs[i], layerIDs[i-1])
-		} else {
-			err = analyzeLayer(*endpoint, path+"/"+layerIDs[i]+"/layer.tar", layerIDs[i], "")
-		}
-		if err != nil {
-			log.Printf("Could not analyze layer: %s\n", err)
-			os.Exit(1)
-		}
+	log.Printf("Analyzing %d layers with %d worker(s)... \n", len(layers), *concurrency)
+	if err := analyzeLayers(*endpoint, layers, *concurrency, *maxRetries, *requestTimeout); err != nil {
+		log.Printf("Could not analyze layers: %s\n", err)
+		os.Exit(1)
 	}
 
 	// Get vulnerabilities.
 	log.Println("Retrieving image's vulnerabilities")
-	layer, err := getLayer(*endpoint, layerIDs[len(layerIDs)-1])
+	clairClient := &http.Client{Timeout: *requestTimeout}
+	layer, err := getLayerWithRetry(clairClient, *endpoint, layers[len(layers)-1].Name, *maxRetries)
 	if err != nil {
 		log.Printf("Could not get layer information: %s\n", err)
 		os.Exit(1)
@@ -180,20 +229,40 @@ func main() {
 	isSafe := true
 	hasVisibleVulnerabilities := false
 
+	// allVulnerabilities holds every (post-whitelist) vulnerability regardless
+	// of -minimum-severity, since the report and -fail-on policy must see the
+	// full set; vulnerabilities is the subset actually printed to the terminal.
+	var allVulnerabilities = make([]vulnerabilityInfo, 0)
 	var vulnerabilities = make([]vulnerabilityInfo, 0)
 	for _, feature := range layer.Features {
-		if len(feature.Vulnerabilities) > 0 {
-			for _, vulnerability := range feature.Vulnerabilities {
-				severity := types.Priority(vulnerability.Severity)
-				isSafe = false
+		for _, vulnerability := range feature.Vulnerabilities {
+			vi := vulnerabilityInfo{
+				vulnerability: vulnerability,
+				feature:       feature,
+				severity:      types.Priority(vulnerability.Severity),
+			}
 
-				if minSeverity.Compare(severity) > 0 {
-					continue
+			if policy != nil {
+				if entry, ok := policy.find(imageName, vi); ok {
+					if entry.Downgrade == "" {
+						// Fully whitelisted: doesn't count towards
+						// isSafe or the -fail-on policy at all.
+						continue
+					}
+					vi.severity = types.Priority(entry.Downgrade)
+					vi.justification = entry.Reason
 				}
+			}
 
-				hasVisibleVulnerabilities = true
-				vulnerabilities = append(vulnerabilities, vulnerabilityInfo{vulnerability, feature, severity})
+			isSafe = false
+			allVulnerabilities = append(allVulnerabilities, vi)
+
+			if minSeverity.Compare(vi.severity) > 0 {
+				continue
 			}
+
+			hasVisibleVulnerabilities = true
+			vulnerabilities = append(vulnerabilities, vi)
 		}
 	}
 
@@ -203,6 +272,23 @@ func main() {
 	}
 
 	By(priority).Sort(vulnerabilities)
+	By(priority).Sort(allVulnerabilities)
+
+	report := newReport(imageName, allVulnerabilities)
+	if *output != "" {
+		if reporter == nil {
+			reporter = jsonReporter{}
+		}
+		data, err := reporter.Report(report)
+		if err != nil {
+			fmt.Printf("Could not generate report: %s\n", err)
+			os.Exit(1)
+		}
+		if err := ioutil.WriteFile(*output, data, 0644); err != nil {
+			fmt.Printf("Could not write report to %s: %s\n", *output, err)
+			os.Exit(1)
+		}
+	}
 
 	for _, vulnerabilityInfo := range vulnerabilities {
 		vulnerability := vulnerabilityInfo.vulnerability
@@ -226,16 +312,29 @@ func main() {
 		}
 
 		fmt.Printf("\tLayer:         %s\n", feature.AddedBy)
+
+		if vulnerabilityInfo.justification != "" {
+			fmt.Printf("\tWhitelisted:   %s\n", vulnerabilityInfo.justification)
+		}
+
 		fmt.Println("")
 	}
 
 	if isSafe {
 		fmt.Printf("%s No vulnerabilities were detected in your image\n", color.GreenString("Success!"))
-		os.Exit(0)
 	} else if !hasVisibleVulnerabilities {
 		fmt.Printf("%s No vulnerabilities matching the minimum severity level were detected in your image\n", color.YellowString("NOTE:"))
-		os.Exit(0)
 	}
+
+	// -fail-on/-fail-on-count is evaluated against the full report
+	// regardless of -minimum-severity, so a quiet terminal (everything
+	// filtered out of the printout) can still gate the build.
+	if shouldFail(report, *failOn, *failOnCount) {
+		fmt.Printf("%s Vulnerabilities exceeding the -fail-on policy were detected in your image\n", color.RedString("Failure!"))
+		os.Exit(1)
+	}
+
+	os.Exit(0)
 }
 
 func save(imageName string) (string, error) {
@@ -352,13 +451,16 @@ func listenHTTP(path, allowedHost string) {
 	}
 }
 
-func analyzeLayer(endpoint, path, layerName, parentLayerName string) error {
+// analyzeLayerWithClient POSTs a single layer to Clair using client, so
+// callers can share one http.Client (with its own timeout) across layers
+// and retries.
+func analyzeLayerWithClient(client *http.Client, endpoint, path, layerName, parentLayerName, format string) error {
 	payload := v1.LayerEnvelope{
 		Layer: &v1.Layer{
 			Name:       layerName,
 			Path:       path,
 			ParentName: parentLayerName,
-			Format:     "Docker",
+			Format:     format,
 		},
 	}
 
@@ -373,7 +475,6 @@ func analyzeLayer(endpoint, path, layerName, parentLayerName string) error {
 	}
 	request.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
 	response, err := client.Do(request)
 	if err != nil {
 		return err
@@ -382,14 +483,17 @@ func analyzeLayer(endpoint, path, layerName, parentLayerName string) error {
 
 	if response.StatusCode != 201 {
 		body, _ := ioutil.ReadAll(response.Body)
-		return fmt.Errorf("Got response %d with message %s", response.StatusCode, string(body))
+		return retryableStatusError{status: response.StatusCode, body: string(body)}
 	}
 
 	return nil
 }
 
-func getLayer(endpoint, layerID string) (v1.Layer, error) {
-	response, err := http.Get(endpoint + fmt.Sprintf(getLayerFeaturesURI, layerID))
+// getLayerWithClient GETs a layer's features/vulnerabilities from Clair
+// using client, so callers can share one http.Client (with its own
+// timeout) and retry through it rather than blocking on the default client.
+func getLayerWithClient(client *http.Client, endpoint, layerID string) (v1.Layer, error) {
+	response, err := client.Get(endpoint + fmt.Sprintf(getLayerFeaturesURI, layerID))
 	if err != nil {
 		return v1.Layer{}, err
 	}
@@ -397,8 +501,7 @@ func getLayer(endpoint, layerID string) (v1.Layer, error) {
 
 	if response.StatusCode != 200 {
 		body, _ := ioutil.ReadAll(response.Body)
-		err := fmt.Errorf("Got response %d with message %s", response.StatusCode, string(body))
-		return v1.Layer{}, err
+		return v1.Layer{}, retryableStatusError{status: response.StatusCode, body: string(body)}
 	}
 
 	var apiResponse v1.LayerEnvelope
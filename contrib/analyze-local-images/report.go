@@ -0,0 +1,271 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"time"
+
+	"github.com/coreos/clair/utils/types"
+)
+
+// Report is the machine-readable result of a scan, grouping every detected
+// vulnerability by severity so it can be serialized for CI systems and
+// security dashboards.
+type Report struct {
+	Registry    string    `json:"registry,omitempty"`
+	Image       string    `json:"image"`
+	Tag         string    `json:"tag,omitempty"`
+	GeneratedAt time.Time `json:"generatedAt"`
+
+	VulnerabilitiesBySeverity map[string][]ReportVulnerability `json:"vulnerabilitiesBySeverity"`
+	BadVulnCounts             map[string]int                   `json:"badVulnCounts"`
+}
+
+// ReportVulnerability is a single vulnerability entry in a Report, flattened
+// from the feature/vulnerability pair returned by Clair.
+type ReportVulnerability struct {
+	Name           string `json:"name"`
+	Severity       string `json:"severity"`
+	FeatureName    string `json:"featureName"`
+	FeatureVersion string `json:"featureVersion"`
+	FixedBy        string `json:"fixedBy,omitempty"`
+	Description    string `json:"description,omitempty"`
+	Link           string `json:"link,omitempty"`
+	AddedBy        string `json:"addedBy,omitempty"`
+	Justification  string `json:"justification,omitempty"`
+}
+
+// newReport builds a Report from the vulnerabilities found for imageName.
+func newReport(imageName string, vulnerabilities []vulnerabilityInfo) *Report {
+	report := &Report{
+		Image:                     imageName,
+		GeneratedAt:               time.Now().UTC(),
+		VulnerabilitiesBySeverity: make(map[string][]ReportVulnerability),
+		BadVulnCounts:             make(map[string]int),
+	}
+
+	for _, v := range vulnerabilities {
+		severity := string(v.severity)
+		report.VulnerabilitiesBySeverity[severity] = append(report.VulnerabilitiesBySeverity[severity], ReportVulnerability{
+			Name:           v.vulnerability.Name,
+			Severity:       severity,
+			FeatureName:    v.feature.Name,
+			FeatureVersion: v.feature.Version,
+			FixedBy:        v.vulnerability.FixedBy,
+			Description:    v.vulnerability.Description,
+			Link:           v.vulnerability.Link,
+			AddedBy:        v.feature.AddedBy,
+			Justification:  v.justification,
+		})
+		report.BadVulnCounts[severity]++
+	}
+
+	return report
+}
+
+// Reporter serializes a Report into a particular machine-readable format.
+type Reporter interface {
+	Report(report *Report) ([]byte, error)
+}
+
+// reporterFor returns the Reporter for the given -format value.
+func reporterFor(format string) (Reporter, error) {
+	switch format {
+	case "json":
+		return jsonReporter{}, nil
+	case "sarif":
+		return sarifReporter{}, nil
+	case "junit":
+		return junitReporter{}, nil
+	default:
+		return nil, fmt.Errorf("unknown report format %q", format)
+	}
+}
+
+type jsonReporter struct{}
+
+func (jsonReporter) Report(report *Report) ([]byte, error) {
+	return json.MarshalIndent(report, "", "  ")
+}
+
+// sarifReporter renders a Report as SARIF 2.1.0 (https://docs.oasis-open.org/sarif/sarif/v2.1.0).
+type sarifReporter struct{}
+
+func (sarifReporter) Report(report *Report) ([]byte, error) {
+	type sarifMessage struct {
+		Text string `json:"text"`
+	}
+	type sarifLocation struct {
+		PhysicalLocation struct {
+			ArtifactLocation struct {
+				URI string `json:"uri"`
+			} `json:"artifactLocation"`
+		} `json:"physicalLocation"`
+	}
+	type sarifResult struct {
+		RuleID    string          `json:"ruleId"`
+		Level     string          `json:"level"`
+		Message   sarifMessage    `json:"message"`
+		Locations []sarifLocation `json:"locations,omitempty"`
+	}
+	type sarifRule struct {
+		ID               string       `json:"id"`
+		ShortDescription sarifMessage `json:"shortDescription"`
+		HelpURI          string       `json:"helpUri,omitempty"`
+	}
+	type sarifDriver struct {
+		Name  string      `json:"name"`
+		Rules []sarifRule `json:"rules"`
+	}
+	type sarifTool struct {
+		Driver sarifDriver `json:"driver"`
+	}
+	type sarifRun struct {
+		Tool    sarifTool     `json:"tool"`
+		Results []sarifResult `json:"results"`
+	}
+	type sarifLog struct {
+		Schema  string     `json:"$schema"`
+		Version string     `json:"version"`
+		Runs    []sarifRun `json:"runs"`
+	}
+
+	rulesSeen := make(map[string]bool)
+	run := sarifRun{
+		Tool: sarifTool{Driver: sarifDriver{Name: "clair-scanner"}},
+	}
+
+	for _, vulns := range report.VulnerabilitiesBySeverity {
+		for _, v := range vulns {
+			if !rulesSeen[v.Name] {
+				rulesSeen[v.Name] = true
+				run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, sarifRule{
+					ID:               v.Name,
+					ShortDescription: sarifMessage{Text: v.Description},
+					HelpURI:          v.Link,
+				})
+			}
+
+			location := sarifLocation{}
+			location.PhysicalLocation.ArtifactLocation.URI = v.AddedBy
+			run.Results = append(run.Results, sarifResult{
+				RuleID:    v.Name,
+				Level:     sarifLevel(v.Severity),
+				Message:   sarifMessage{Text: fmt.Sprintf("%s @ %s is affected by %s", v.FeatureName, v.FeatureVersion, v.Name)},
+				Locations: []sarifLocation{location},
+			})
+		}
+	}
+
+	log := sarifLog{
+		Schema:  "https://raw.githubusercontent.com/oasis-tcs/sarif-spec/master/Schemata/sarif-schema-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []sarifRun{run},
+	}
+
+	return json.MarshalIndent(log, "", "  ")
+}
+
+func sarifLevel(severity string) string {
+	switch types.Priority(severity) {
+	case types.High, types.Critical, types.Defcon1:
+		return "error"
+	case types.Medium:
+		return "warning"
+	default:
+		return "note"
+	}
+}
+
+// junitReporter renders a Report as a JUnit test suite, one testcase per
+// vulnerability, so CI systems that already parse JUnit can surface results
+// without a dedicated plugin.
+type junitReporter struct{}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name    string        `xml:"name,attr"`
+	Failure *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func (junitReporter) Report(report *Report) ([]byte, error) {
+	suite := junitTestSuite{Name: report.Image}
+
+	for severity, vulns := range report.VulnerabilitiesBySeverity {
+		for _, v := range vulns {
+			suite.Tests++
+			suite.Failures++
+			suite.TestCases = append(suite.TestCases, junitTestCase{
+				Name: fmt.Sprintf("[%s] %s in %s @ %s", severity, v.Name, v.FeatureName, v.FeatureVersion),
+				Failure: &junitFailure{
+					Message: v.Description,
+					Text:    v.Link,
+				},
+			})
+		}
+	}
+
+	out, err := xml.MarshalIndent(junitTestSuites{Suites: []junitTestSuite{suite}}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), out...), nil
+}
+
+// shouldFail implements the -fail-on and -fail-on-count exit-code policies:
+// the scan is considered failing if any vulnerability meets or exceeds
+// failOnSeverity, or if the total vulnerability count reaches failOnCount.
+func shouldFail(report *Report, failOnSeverity string, failOnCount int) bool {
+	total := 0
+	for _, count := range report.BadVulnCounts {
+		total += count
+	}
+	if failOnCount > 0 && total >= failOnCount {
+		return true
+	}
+
+	if failOnSeverity == "" {
+		return false
+	}
+	threshold := types.Priority(failOnSeverity)
+	for severity, count := range report.BadVulnCounts {
+		if count == 0 {
+			continue
+		}
+		if types.Priority(severity).Compare(threshold) >= 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// whitelistEntry describes one accepted vulnerability exception, optionally
+// scoped to a specific image, package or namespace. An entry either
+// suppresses the vulnerability outright (it is left out of the report) or,
+// when Downgrade is set, downgrades its severity and shows Reason in the
+// report as a justification.
+type whitelistEntry struct {
+	CVE       string `yaml:"cve"`
+	Image     string `yaml:"image,omitempty"`
+	Package   string `yaml:"package,omitempty"`
+	Namespace string `yaml:"namespace,omitempty"`
+	Downgrade string `yaml:"downgradeTo,omitempty"`
+	Reason    string `yaml:"reason,omitempty"`
+	Expires   string `yaml:"expires,omitempty"` // YYYY-MM-DD; entry stops applying after this date
+}
+
+// whitelist is the policy loaded from -whitelist.
+type whitelist struct {
+	Entries []whitelistEntry `yaml:"whitelist"`
+}
+
+// loadWhitelist reads and parses a -whitelist policy file.
+func loadWhitelist(path string) (*whitelist, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var w whitelist
+	if err := yaml.Unmarshal(data, &w); err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+// find returns the first non-expired entry in the whitelist matching
+// imageName and vi, if any.
+func (w *whitelist) find(imageName string, vi vulnerabilityInfo) (*whitelistEntry, bool) {
+	for i := range w.Entries {
+		entry := &w.Entries[i]
+
+		if entry.CVE != vi.vulnerability.Name {
+			continue
+		}
+		if entry.Image != "" && entry.Image != imageName {
+			continue
+		}
+		if entry.Package != "" && entry.Package != vi.feature.Name {
+			continue
+		}
+		if entry.Namespace != "" && entry.Namespace != vi.feature.NamespaceName {
+			continue
+		}
+		if entry.expired() {
+			continue
+		}
+
+		return entry, true
+	}
+	return nil, false
+}
+
+// expired reports whether entry's Expires date has passed, so that stale
+// exceptions resurface instead of silently hiding vulnerabilities forever.
+func (e *whitelistEntry) expired() bool {
+	if e.Expires == "" {
+		return false
+	}
+	t, err := time.Parse("2006-01-02", e.Expires)
+	if err != nil {
+		// An unparseable date is treated as already expired so the
+		// entry is visibly broken rather than silently permanent.
+		return true
+	}
+	// Expires is a date, not an instant: the entry is valid through the
+	// end of that day, not just until midnight at its start.
+	return time.Now().After(t.Add(24 * time.Hour))
+}
@@ -0,0 +1,188 @@
+// Copyright 2015 clair authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coreos/clair/api/v1"
+)
+
+const (
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 30 * time.Second
+)
+
+// analyzeLayers submits every layer to Clair using a bounded worker pool,
+// while honoring the constraint that a layer can only be POSTed once its
+// parent has already been accepted. Layers with no dependency on one
+// another are analyzed concurrently; a layer whose parent is still pending
+// simply waits on that parent's done channel before calling
+// analyzeLayerWithRetry.
+func analyzeLayers(endpoint string, layers []imageLayer, concurrency, maxRetries int, timeout time.Duration) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	client := &http.Client{Timeout: timeout}
+
+	done := make(map[string]chan struct{}, len(layers))
+	for _, layer := range layers {
+		done[layer.Name] = make(chan struct{})
+	}
+
+	// failed records layers that did not make it into Clair, so a child
+	// waiting on a failed parent's done channel knows to skip rather than
+	// POST itself against a parent Clair never accepted.
+	var mu sync.Mutex
+	failed := make(map[string]error, len(layers))
+
+	jobs := make(chan imageLayer)
+	errCh := make(chan error, len(layers))
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for layer := range jobs {
+				var err error
+
+				if layer.ParentName != "" {
+					<-done[layer.ParentName]
+
+					mu.Lock()
+					parentErr, parentFailed := failed[layer.ParentName]
+					mu.Unlock()
+
+					if parentFailed {
+						err = fmt.Errorf("skipped because parent layer %s failed: %s", layer.ParentName, parentErr)
+					}
+				}
+
+				if err == nil {
+					err = analyzeLayerWithRetry(client, endpoint, layer, maxRetries)
+				}
+
+				if err != nil {
+					wrapped := fmt.Errorf("could not analyze layer %s: %s", layer.Name, err)
+					mu.Lock()
+					failed[layer.Name] = wrapped
+					mu.Unlock()
+					errCh <- wrapped
+				}
+
+				close(done[layer.Name])
+			}
+		}()
+	}
+
+	for _, layer := range layers {
+		jobs <- layer
+	}
+	close(jobs)
+	wg.Wait()
+	close(errCh)
+
+	// Surface the first error encountered; the rest are dropped, since a
+	// single failure is enough to fail the whole scan.
+	for err := range errCh {
+		return err
+	}
+	return nil
+}
+
+// analyzeLayerWithRetry calls analyzeLayerWithClient, retrying with exponential
+// backoff and jitter when Clair responds with a 5xx status or the request
+// times out.
+func analyzeLayerWithRetry(client *http.Client, endpoint string, layer imageLayer, maxRetries int) error {
+	return retryWithBackoff(maxRetries, func() error {
+		return analyzeLayerWithClient(client, endpoint, layer.Path, layer.Name, layer.ParentName, layer.Format)
+	})
+}
+
+// getLayerWithRetry calls getLayerWithClient, retrying with the same backoff/jitter
+// policy as analyzeLayerWithRetry, so the final vulnerability fetch doesn't
+// block forever on a hung Clair either.
+func getLayerWithRetry(client *http.Client, endpoint, layerID string, maxRetries int) (v1.Layer, error) {
+	var layer v1.Layer
+	err := retryWithBackoff(maxRetries, func() error {
+		l, err := getLayerWithClient(client, endpoint, layerID)
+		if err != nil {
+			return err
+		}
+		layer = l
+		return nil
+	})
+	return layer, err
+}
+
+// retryWithBackoff runs fn, retrying with exponential backoff and jitter
+// while its error is retryable, up to maxRetries times.
+func retryWithBackoff(maxRetries int, fn func() error) error {
+	var err error
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+		if !isRetryable(err) || attempt == maxRetries {
+			return err
+		}
+
+		time.Sleep(backoffDelay(attempt))
+	}
+	return err
+}
+
+// backoffDelay returns an exponentially increasing delay, capped at
+// retryMaxDelay, with up to 50% random jitter to avoid thundering-herd
+// retries against Clair.
+func backoffDelay(attempt int) time.Duration {
+	delay := retryBaseDelay * time.Duration(1<<uint(attempt))
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	jitter := time.Duration(rand.Int63n(int64(delay) / 2))
+	return delay/2 + jitter
+}
+
+// isRetryable reports whether err looks like a transient failure: a
+// network timeout, or a retryableStatusError for a 5xx response.
+func isRetryable(err error) bool {
+	if statusErr, ok := err.(retryableStatusError); ok {
+		return statusErr.status >= 500
+	}
+	if netErr, ok := err.(net.Error); ok {
+		return netErr.Timeout()
+	}
+	return false
+}
+
+// retryableStatusError wraps a non-2xx HTTP response so isRetryable can
+// inspect the status code without parsing the error string.
+type retryableStatusError struct {
+	status int
+	body   string
+}
+
+func (e retryableStatusError) Error() string {
+	return fmt.Sprintf("got response %d with message %s", e.status, e.body)
+}